@@ -0,0 +1,299 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Exporter publishes a discovery run's targets to a destination Prometheus
+// can be configured to read from.
+type Exporter interface {
+	Export(targets []*Targets) error
+}
+
+// newExporter builds the Exporter selected by config.ExporterType.
+func newExporter(config *Config) (Exporter, error) {
+	switch config.ExporterType {
+	case "file":
+		return &FileExporter{Path: config.Target}, nil
+	case "consul":
+		tlsConfig, err := buildTLSConfig(config.ConsulCA, config.ConsulCert, config.ConsulKey, config.ConsulNoVerify)
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		return &ConsulExporter{Addr: config.ConsulAddr, Client: client}, nil
+	case "etcd":
+		tlsConfig, err := buildTLSConfig(config.EtcdCA, config.EtcdCert, config.EtcdKey, config.EtcdNoVerify)
+		if err != nil {
+			return nil, err
+		}
+		client := &http.Client{Transport: &http.Transport{TLSClientConfig: tlsConfig}}
+		return &EtcdExporter{Endpoints: config.EtcdEndpoints, Client: client}, nil
+	default:
+		return nil, fmt.Errorf("unknown --exporter %q, expected file, consul or etcd", config.ExporterType)
+	}
+}
+
+// FileExporter writes targets to a JSON file in the schema
+// Prometheus' file_sd_configs expects. Writes are atomic (temp file plus
+// rename) and skipped entirely when the content hasn't changed, so
+// Prometheus doesn't reload on every poll.
+type FileExporter struct {
+	Path string
+
+	last []byte
+}
+
+func (e *FileExporter) Export(targets []*Targets) error {
+	data, err := json.MarshalIndent(targets, "", "  ")
+	if err != nil {
+		return err
+	}
+	data = append(data, '\n')
+	if bytes.Equal(data, e.last) {
+		return nil
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(e.Path), filepath.Base(e.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	// ioutil.TempFile creates the file 0600; match the 0644 the old
+	// ioutil.WriteFile path used so a Prometheus running as another user can
+	// still read it off a shared filesystem.
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), e.Path); err != nil {
+		return err
+	}
+	e.last = data
+	return nil
+}
+
+// ConsulExporter registers each discovered target as a Consul service,
+// tagged with its cluster label, via the Consul HTTP API. Targets that
+// disappear between runs (VM stopped, host removed, ...) are deregistered,
+// since Consul never expires a service registration on its own.
+type ConsulExporter struct {
+	Addr   string
+	Client *http.Client
+
+	lastServiceIDs map[string]bool
+}
+
+type consulServiceRegistration struct {
+	ID      string   `json:"ID"`
+	Name    string   `json:"Name"`
+	Address string   `json:"Address"`
+	Port    int      `json:"Port"`
+	Tags    []string `json:"Tags"`
+}
+
+func (e *ConsulExporter) Export(targets []*Targets) error {
+	serviceIDs := make(map[string]bool)
+	for _, target := range targets {
+		var tags []string
+		for key, value := range target.Labels {
+			tags = append(tags, key+"="+value)
+		}
+		for _, address := range target.Targets {
+			host, port := splitHostPort(address)
+			id := "ovirt-" + address
+			serviceIDs[id] = true
+			registration := consulServiceRegistration{
+				ID:      id,
+				Name:    "ovirt-target",
+				Address: host,
+				Port:    port,
+				Tags:    tags,
+			}
+			body, err := json.Marshal(registration)
+			if err != nil {
+				return err
+			}
+			req, err := http.NewRequest("PUT", e.Addr+"/v1/agent/service/register", bytes.NewReader(body))
+			if err != nil {
+				return err
+			}
+			req.Header.Set("Content-Type", "application/json")
+			res, err := e.Client.Do(req)
+			if err != nil {
+				return err
+			}
+			res.Body.Close()
+			if res.StatusCode != http.StatusOK {
+				return fmt.Errorf("consul registration of %s failed with status %d", address, res.StatusCode)
+			}
+		}
+	}
+
+	for id := range e.lastServiceIDs {
+		if serviceIDs[id] {
+			continue
+		}
+		req, err := http.NewRequest("PUT", e.Addr+"/v1/agent/service/deregister/"+id, nil)
+		if err != nil {
+			return err
+		}
+		res, err := e.Client.Do(req)
+		if err != nil {
+			return err
+		}
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			return fmt.Errorf("consul deregistration of %s failed with status %d", id, res.StatusCode)
+		}
+	}
+	e.lastServiceIDs = serviceIDs
+	return nil
+}
+
+// EtcdExporter writes each cluster's targets to a key in etcd, via etcd's
+// v3 gRPC-gateway JSON API. Keys for clusters that no longer have any
+// targets are deleted, and requests fail over across all configured
+// endpoints rather than only ever talking to the first one.
+type EtcdExporter struct {
+	Endpoints []string
+	Client    *http.Client
+
+	lastKeys map[string]bool
+}
+
+type etcdPutRequest struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type etcdDeleteRangeRequest struct {
+	Key string `json:"key"`
+}
+
+// clusterKey picks the cluster identity to group a target's etcd key by.
+// HostLabels sets "cluster" directly; VMLabels only sets
+// __meta_ovirt_cluster_name, so that's checked as a fallback before
+// giving up and lumping the target under "default".
+func clusterKey(labels map[string]string) string {
+	if cluster := labels["cluster"]; cluster != "" {
+		return cluster
+	}
+	if cluster := labels["__meta_ovirt_cluster_name"]; cluster != "" {
+		return cluster
+	}
+	return "default"
+}
+
+func (e *EtcdExporter) Export(targets []*Targets) error {
+	byCluster := make(map[string][]*Targets)
+	for _, target := range targets {
+		cluster := clusterKey(target.Labels)
+		byCluster[cluster] = append(byCluster[cluster], target)
+	}
+
+	keys := make(map[string]bool, len(byCluster))
+	for cluster, clusterTargets := range byCluster {
+		key := "/ovirt-prometheus-bridge/" + cluster
+		keys[key] = true
+		data, err := json.Marshal(clusterTargets)
+		if err != nil {
+			return err
+		}
+		if err := e.put(key, data); err != nil {
+			return err
+		}
+	}
+
+	for key := range e.lastKeys {
+		if keys[key] {
+			continue
+		}
+		if err := e.delete(key); err != nil {
+			return err
+		}
+	}
+	e.lastKeys = keys
+	return nil
+}
+
+func (e *EtcdExporter) put(key string, value []byte) error {
+	body, err := json.Marshal(etcdPutRequest{
+		Key:   base64.StdEncoding.EncodeToString([]byte(key)),
+		Value: base64.StdEncoding.EncodeToString(value),
+	})
+	if err != nil {
+		return err
+	}
+	if err := e.doWithFailover("/v3/kv/put", body); err != nil {
+		return fmt.Errorf("etcd put of key %s: %w", key, err)
+	}
+	return nil
+}
+
+func (e *EtcdExporter) delete(key string) error {
+	body, err := json.Marshal(etcdDeleteRangeRequest{
+		Key: base64.StdEncoding.EncodeToString([]byte(key)),
+	})
+	if err != nil {
+		return err
+	}
+	if err := e.doWithFailover("/v3/kv/deleterange", body); err != nil {
+		return fmt.Errorf("etcd delete of key %s: %w", key, err)
+	}
+	return nil
+}
+
+// doWithFailover POSTs body to path on each configured endpoint in turn,
+// returning on the first success and only failing once every endpoint has
+// been tried, so a single down member doesn't take the exporter down.
+func (e *EtcdExporter) doWithFailover(path string, body []byte) error {
+	var lastErr error
+	for _, endpoint := range e.Endpoints {
+		req, err := http.NewRequest("POST", endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		res, err := e.Client.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		respBody, _ := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if res.StatusCode != http.StatusOK {
+			lastErr = fmt.Errorf("%s returned status %d: %s", endpoint, res.StatusCode, respBody)
+			continue
+		}
+		return nil
+	}
+	return lastErr
+}
+
+// splitHostPort splits a Prometheus target address into host and port,
+// defaulting to port 0 when the address has none.
+func splitHostPort(address string) (string, int) {
+	idx := strings.LastIndex(address, ":")
+	if idx == -1 {
+		return address, 0
+	}
+	host := address[:idx]
+	var port int
+	fmt.Sscanf(address[idx+1:], "%d", &port)
+	return host, port
+}
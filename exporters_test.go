@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestSplitHostPort(t *testing.T) {
+	cases := []struct {
+		address  string
+		wantHost string
+		wantPort int
+	}{
+		{"192.0.2.1:9100", "192.0.2.1", 9100},
+		{"host.example.com:9100", "host.example.com", 9100},
+		{"192.0.2.1", "192.0.2.1", 0},
+	}
+	for _, c := range cases {
+		host, port := splitHostPort(c.address)
+		if host != c.wantHost || port != c.wantPort {
+			t.Errorf("splitHostPort(%q) = (%q, %d), want (%q, %d)", c.address, host, port, c.wantHost, c.wantPort)
+		}
+	}
+}
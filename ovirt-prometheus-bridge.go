@@ -5,10 +5,13 @@ import (
 	"crypto/x509"
 	"encoding/json"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"sort"
 	"strings"
 	"time"
 )
@@ -23,22 +26,67 @@ type Hosts struct {
 }
 
 type Host struct {
+	Id      string
 	Address string
 	Cluster Cluster
 }
 
 type Cluster struct {
-	Id string
+	Id         string
+	Name       string
+	DataCenter DataCenter `json:"data_center"`
+}
+
+type DataCenter struct {
+	Id   string
+	Name string
+}
+
+// LabelExtractor turns a single discovered item (a Host or a VM) into the
+// scrape address and the Prometheus meta labels describing it.
+type LabelExtractor func(item interface{}) (address string, labels map[string]string)
+
+// HostLabels is the LabelExtractor for items discovered via --discover=hosts.
+func HostLabels(item interface{}) (string, map[string]string) {
+	host := item.(Host)
+	return host.Address, map[string]string{"cluster": host.Cluster.Id}
 }
 
 type Config struct {
-	Target         string
-	URL            string
-	User           string
-	Password       string
-	NoVerify       bool
-	EngineCA       string
-	UpdateInterval int
+	Target             string
+	URL                string
+	User               string
+	Password           string
+	NoVerify           bool
+	EngineCA           string
+	UpdateInterval     int
+	AuthMode           string
+	ClientCert         string
+	ClientKey          string
+	TokenCacheTTL      int
+	Discover           []string
+	Port               int
+	ExporterType       string
+	ConsulAddr         string
+	ConsulCA           string
+	ConsulCert         string
+	ConsulKey          string
+	ConsulNoVerify     bool
+	EtcdEndpoints      []string
+	EtcdCA             string
+	EtcdCert           string
+	EtcdKey            string
+	EtcdNoVerify       bool
+	FullResyncInterval int
+
+	token       string
+	tokenExpiry time.Time
+}
+
+// ssoToken is the subset of oVirt Engine's SSO token response we care about.
+type ssoToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int    `json:"expires_in"`
 }
 
 func main() {
@@ -48,65 +96,265 @@ func main() {
 	enginePassword := flag.String("engine-password", "", "Engine password. Consider using ENGINE_PASSWORD environment variable to set this")
 	noVerify := flag.Bool("no-verify", false, "Don't verify the engine certificate")
 	engineCa := flag.String("engine-ca", "/etc/pki/vdsm/certs/cacert.pem", "Path to engine ca certificate")
-	updateInterval := flag.Int("update-interval", 60, "Update intervall for host discovery in seconds")
+	updateInterval := flag.Int("update-interval", 60, "Cap in seconds for Engine-request backoff; /-/ready turns unhealthy after 2x this many seconds of failed discovery")
+	authMode := flag.String("auth-mode", "basic", "Engine authentication mode: basic, sso or mtls")
+	engineCert := flag.String("engine-cert", "", "Path to client certificate for mTLS authentication")
+	engineKey := flag.String("engine-key", "", "Path to client private key for mTLS authentication")
+	tokenCacheTTL := flag.Int("token-cache-ttl", 300, "Fallback TTL in seconds to cache SSO tokens when the Engine doesn't report an expiry")
+	listen := flag.String("listen", "", "Address to listen on for HTTP (serves /targets and /metrics); when set, Prometheus can scrape the bridge directly instead of relying on the shared output file")
+	discover := flag.String("discover", "hosts", "Comma-separated list of what to discover: hosts, vms")
+	port := flag.Int("port", 9100, "Port to append to VM target addresses, e.g. for node_exporter")
+	exporterType := flag.String("exporter", "file", "Where to publish discovered targets: file, consul or etcd")
+	consulAddr := flag.String("consul-addr", "http://127.0.0.1:8500", "Consul HTTP API address")
+	consulCa := flag.String("consul-ca", "", "Path to CA certificate for the Consul HTTP API")
+	consulCert := flag.String("consul-cert", "", "Path to client certificate for the Consul HTTP API")
+	consulKey := flag.String("consul-key", "", "Path to client private key for the Consul HTTP API")
+	consulNoVerify := flag.Bool("consul-no-verify", false, "Don't verify the Consul HTTP API certificate")
+	etcdEndpoints := flag.String("etcd-endpoints", "http://127.0.0.1:2379", "Comma-separated list of etcd endpoints")
+	etcdCa := flag.String("etcd-ca", "", "Path to CA certificate for etcd")
+	etcdCert := flag.String("etcd-cert", "", "Path to client certificate for etcd")
+	etcdKey := flag.String("etcd-key", "", "Path to client private key for etcd")
+	etcdNoVerify := flag.Bool("etcd-no-verify", false, "Don't verify the etcd certificate")
+	fullResyncInterval := flag.Int("full-resync-interval", 600, "Full re-sync interval in seconds, used as a fallback alongside event-driven refreshes")
 	flag.Parse()
 	if *enginePassword == "" {
 		*enginePassword = os.Getenv("ENGINE_PASSWORD")
 	}
 	config := Config{Target: *target,
-		URL:            *engineURL,
-		User:           *engineUser,
-		Password:       *enginePassword,
-		NoVerify:       *noVerify,
-		EngineCA:       *engineCa,
-		UpdateInterval: *updateInterval,
+		URL:                *engineURL,
+		User:               *engineUser,
+		Password:           *enginePassword,
+		NoVerify:           *noVerify,
+		EngineCA:           *engineCa,
+		UpdateInterval:     *updateInterval,
+		AuthMode:           *authMode,
+		ClientCert:         *engineCert,
+		ClientKey:          *engineKey,
+		TokenCacheTTL:      *tokenCacheTTL,
+		Discover:           strings.Split(*discover, ","),
+		Port:               *port,
+		ExporterType:       *exporterType,
+		ConsulAddr:         *consulAddr,
+		ConsulCA:           *consulCa,
+		ConsulCert:         *consulCert,
+		ConsulKey:          *consulKey,
+		ConsulNoVerify:     *consulNoVerify,
+		EtcdEndpoints:      strings.Split(*etcdEndpoints, ","),
+		EtcdCA:             *etcdCa,
+		EtcdCert:           *etcdCert,
+		EtcdKey:            *etcdKey,
+		EtcdNoVerify:       *etcdNoVerify,
+		FullResyncInterval: *fullResyncInterval,
 	}
 
 	if !strings.HasPrefix(config.URL, "https") {
 		log.Fatal("Only URLs starting with 'https' are supported")
 	}
-	if config.Password == "" {
-		log.Fatal("No engine password supplied")
+	switch config.AuthMode {
+	case "basic", "sso":
+		if config.Password == "" {
+			log.Fatal("No engine password supplied")
+		}
+	case "mtls":
+		if config.ClientCert == "" || config.ClientKey == "" {
+			log.Fatal("mTLS auth mode requires --engine-cert and --engine-key")
+		}
+	default:
+		log.Fatalf("Unknown auth mode %q, expected basic, sso or mtls", config.AuthMode)
+	}
+
+	engineCertPair := ""
+	engineKeyPair := ""
+	if config.AuthMode == "mtls" {
+		engineCertPair = config.ClientCert
+		engineKeyPair = config.ClientKey
+	}
+	tlsConfig, err := buildTLSConfig(config.EngineCA, engineCertPair, engineKeyPair, config.NoVerify)
+	check(err)
+	transport := &http.Transport{TLSClientConfig: tlsConfig}
+	client := &http.Client{Transport: transport}
+
+	exporter, err := newExporter(&config)
+	check(err)
+
+	var store *targetStore
+	if *listen != "" {
+		store = &targetStore{}
+		go serveTargets(*listen, store)
 	}
 
+	runSupervisor(client, &config, exporter, store)
+}
+
+// buildTLSConfig assembles a tls.Config from a CA bundle and an optional
+// client certificate/key pair, the same way for the Engine, Consul and etcd
+// connections.
+func buildTLSConfig(caPath, certPath, keyPath string, noVerify bool) (*tls.Config, error) {
 	tlsConfig := &tls.Config{
-		InsecureSkipVerify: config.NoVerify,
+		InsecureSkipVerify: noVerify,
 	}
-	if !config.NoVerify {
+	if !noVerify && caPath != "" {
 		roots := x509.NewCertPool()
-		ok := roots.AppendCertsFromPEM(readFile(config.EngineCA))
+		ok := roots.AppendCertsFromPEM(readFile(caPath))
 		if !ok {
-			log.Panic("Could not load root CA certificate")
+			return nil, fmt.Errorf("could not load root CA certificate from %s", caPath)
 		}
-
 		tlsConfig.RootCAs = roots
 	}
+	if certPath != "" && keyPath != "" {
+		cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
 	tlsConfig.BuildNameToCertificate()
-	transport := &http.Transport{TLSClientConfig: tlsConfig}
-	client := &http.Client{Transport: transport}
-	for {
-		Discover(client, &config)
-		time.Sleep(time.Duration(config.UpdateInterval) * time.Second)
+	return tlsConfig, nil
+}
+
+func Discover(client *http.Client, config *Config, exporter Exporter) ([]*Targets, error) {
+	var targets []*Targets
+	for _, source := range config.Discover {
+		switch strings.TrimSpace(source) {
+		case "hosts":
+			hostTargets, err := discoverHosts(client, config)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, hostTargets...)
+		case "vms":
+			vmTargets, err := discoverVMs(client, config)
+			if err != nil {
+				return nil, err
+			}
+			targets = append(targets, vmTargets...)
+		default:
+			return nil, fmt.Errorf("unknown --discover source %q, expected hosts or vms", source)
+		}
+	}
+	if err := exporter.Export(targets); err != nil {
+		return nil, err
 	}
+	return targets, nil
 }
 
-func Discover(client *http.Client, config *Config) {
-	req, err := http.NewRequest("GET", config.URL+"/ovirt-engine/api/hosts", nil)
-	check(err)
+func discoverHosts(client *http.Client, config *Config) ([]*Targets, error) {
+	res, err := doAuthenticatedGet(client, config, config.URL+"/ovirt-engine/api/hosts")
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	hosts := ParseJson(body)
+	items := make([]interface{}, len(hosts.Host))
+	for i, host := range hosts.Host {
+		items[i] = host
+	}
+	return MapToTarget(items, HostLabels), nil
+}
+
+func countTargets(targets []*Targets) int {
+	count := 0
+	for _, t := range targets {
+		count += len(t.Targets)
+	}
+	return count
+}
+
+// doAuthenticatedGet issues a GET request against the Engine API, applying
+// whichever AuthMode is configured. For AuthMode "sso" it transparently
+// retries once with a freshly fetched token if the cached one was rejected.
+func doAuthenticatedGet(client *http.Client, config *Config, url string) (*http.Response, error) {
+	req, err := newEngineRequest(client, config, url)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if config.AuthMode == "sso" && res.StatusCode == http.StatusUnauthorized {
+		res.Body.Close()
+		config.token = ""
+		req, err = newEngineRequest(client, config, url)
+		if err != nil {
+			return nil, err
+		}
+		res, err = client.Do(req)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return res, nil
+}
+
+func newEngineRequest(client *http.Client, config *Config, url string) (*http.Request, error) {
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Add("Accept", "application/json")
-	req.SetBasicAuth(config.User, config.Password)
+	switch config.AuthMode {
+	case "basic":
+		req.SetBasicAuth(config.User, config.Password)
+	case "mtls":
+		// Client identity is established by the transport's TLS certificate.
+	case "sso":
+		token, err := ssoAccessToken(client, config)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	return req, nil
+}
+
+// ssoAccessToken returns a cached SSO bearer token, fetching and caching a
+// new one from the Engine if the cache is empty or expired.
+func ssoAccessToken(client *http.Client, config *Config) (string, error) {
+	if config.token != "" && time.Now().Before(config.tokenExpiry) {
+		return config.token, nil
+	}
+
+	form := url.Values{}
+	form.Set("grant_type", "password")
+	form.Set("scope", "ovirt-app-api")
+	form.Set("username", config.User)
+	form.Set("password", config.Password)
+
+	req, err := http.NewRequest("POST", config.URL+"/ovirt-engine/sso/oauth/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
 	res, err := client.Do(req)
 	if err != nil {
-		log.Print(err)
-		return
+		return "", err
 	}
-	hosts, err := ioutil.ReadAll(res.Body)
-	res.Body.Close()
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		log.Print(err)
-		return
+		return "", err
+	}
+	if res.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("sso token request failed with status %d: %s", res.StatusCode, body)
+	}
+
+	var token ssoToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return "", err
+	}
+	ttl := token.ExpiresIn
+	if ttl <= 0 {
+		ttl = config.TokenCacheTTL
 	}
-	writeTargets(config.Target, MapToTarget(ParseJson(hosts)))
+	config.token = token.AccessToken
+	config.tokenExpiry = time.Now().Add(time.Duration(ttl) * time.Second)
+	return config.token, nil
 }
 
 func ParseJson(data []byte) *Hosts {
@@ -116,27 +364,44 @@ func ParseJson(data []byte) *Hosts {
 	return hosts
 }
 
-func MapToTarget(hosts *Hosts) []*Targets {
+// MapToTarget groups discovered items (via extract) into Prometheus
+// http_sd_configs target blocks, folding items that resolve to an identical
+// label set into a single block with multiple target addresses.
+func MapToTarget(items []interface{}, extract LabelExtractor) []*Targets {
 	targetMap := make(map[string]*Targets)
 	var targets []*Targets
-	for _, host := range hosts.Host {
-		if value, ok := targetMap[host.Cluster.Id]; ok {
-			value.Targets = append(value.Targets, host.Address)
+	for _, item := range items {
+		address, labels := extract(item)
+		if address == "" {
+			continue
+		}
+		key := labelKey(labels)
+		if value, ok := targetMap[key]; ok {
+			value.Targets = append(value.Targets, address)
 		} else {
-			targetMap[host.Cluster.Id] = &Targets{
-				Labels:  map[string]string{"cluster": host.Cluster.Id},
-				Targets: []string{host.Address}}
-			targets = append(targets, targetMap[host.Cluster.Id])
+			targetMap[key] = &Targets{Labels: labels, Targets: []string{address}}
+			targets = append(targets, targetMap[key])
 		}
 	}
 	return targets
 }
 
-func writeTargets(fileName string, targets []*Targets) {
-	data, _ := json.MarshalIndent(targets, "", "  ")
-	data = append(data, '\n')
-	err := ioutil.WriteFile(fileName, data, 0644)
-	check(err)
+// labelKey returns a stable string representation of a label set, used to
+// group items that share identical labels into the same target block.
+func labelKey(labels map[string]string) string {
+	keys := make([]string, 0, len(labels))
+	for k := range labels {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteByte('=')
+		b.WriteString(labels[k])
+		b.WriteByte(';')
+	}
+	return b.String()
 }
 
 func check(e error) {
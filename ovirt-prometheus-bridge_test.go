@@ -0,0 +1,54 @@
+package main
+
+import "testing"
+
+func TestMapToTargetGroupsByLabelSet(t *testing.T) {
+	items := []interface{}{
+		Host{Address: "host1:9100", Cluster: Cluster{Id: "cluster-a"}},
+		Host{Address: "host2:9100", Cluster: Cluster{Id: "cluster-a"}},
+		Host{Address: "host3:9100", Cluster: Cluster{Id: "cluster-b"}},
+	}
+
+	targets := MapToTarget(items, HostLabels)
+
+	if len(targets) != 2 {
+		t.Fatalf("expected 2 target blocks, got %d: %+v", len(targets), targets)
+	}
+	for _, target := range targets {
+		if target.Labels["cluster"] == "cluster-a" && len(target.Targets) != 2 {
+			t.Errorf("expected cluster-a block to have 2 targets, got %v", target.Targets)
+		}
+		if target.Labels["cluster"] == "cluster-b" && len(target.Targets) != 1 {
+			t.Errorf("expected cluster-b block to have 1 target, got %v", target.Targets)
+		}
+	}
+}
+
+func TestMapToTargetSkipsItemsWithNoAddress(t *testing.T) {
+	items := []interface{}{
+		Host{Address: "", Cluster: Cluster{Id: "cluster-a"}},
+		Host{Address: "host1:9100", Cluster: Cluster{Id: "cluster-a"}},
+	}
+
+	targets := MapToTarget(items, HostLabels)
+
+	if len(targets) != 1 || len(targets[0].Targets) != 1 {
+		t.Fatalf("expected the addressless item to be skipped, got %+v", targets)
+	}
+}
+
+func TestLabelKeyIsOrderIndependent(t *testing.T) {
+	a := labelKey(map[string]string{"cluster": "x", "zone": "a"})
+	b := labelKey(map[string]string{"zone": "a", "cluster": "x"})
+	if a != b {
+		t.Errorf("labelKey should not depend on map iteration order: %q != %q", a, b)
+	}
+}
+
+func TestLabelKeyDistinguishesDifferentLabels(t *testing.T) {
+	a := labelKey(map[string]string{"cluster": "x"})
+	b := labelKey(map[string]string{"cluster": "y"})
+	if a == b {
+		t.Errorf("labelKey should differ for different label sets, both produced %q", a)
+	}
+}
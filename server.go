@@ -0,0 +1,109 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	discoverySuccesses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ovirt_bridge_discovery_success_total",
+		Help: "Number of successful discovery runs against the Engine API.",
+	})
+	discoveryFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ovirt_bridge_discovery_failure_total",
+		Help: "Number of failed discovery runs against the Engine API.",
+	})
+	discoveredHosts = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ovirt_bridge_discovered_hosts",
+		Help: "Number of hosts returned by the last successful discovery run.",
+	})
+	lastRunTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ovirt_bridge_last_run_timestamp_seconds",
+		Help: "Unix timestamp of the last discovery run, successful or not.",
+	})
+	eventPollSuccesses = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ovirt_bridge_event_poll_success_total",
+		Help: "Number of successful event-feed lookups/polls against the Engine API, used for incremental topology refresh in between full discovery runs.",
+	})
+	eventPollFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "ovirt_bridge_event_poll_failure_total",
+		Help: "Number of failed event-feed lookups/polls against the Engine API.",
+	})
+	lastEventPollTimestamp = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "ovirt_bridge_last_event_poll_timestamp_seconds",
+		Help: "Unix timestamp of the last event-feed lookup/poll, successful or not.",
+	})
+	requestDuration = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "ovirt_bridge_engine_request_duration_seconds",
+		Help:    "Latency of discovery requests made to the Engine API.",
+		Buckets: prometheus.DefBuckets,
+	})
+)
+
+// targetStore holds the most recently discovered targets plus a health flag,
+// so the HTTP server can serve them without touching the filesystem.
+type targetStore struct {
+	mu      sync.RWMutex
+	targets []*Targets
+	healthy bool
+}
+
+func (s *targetStore) set(targets []*Targets) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets = targets
+}
+
+func (s *targetStore) get() []*Targets {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.targets
+}
+
+func (s *targetStore) setHealthy(healthy bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.healthy = healthy
+}
+
+func (s *targetStore) isHealthy() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.healthy
+}
+
+// serveTargets starts an HTTP server exposing the targets Prometheus'
+// http_sd_configs expects on /targets, the bridge's own instrumentation on
+// /metrics, and /-/healthy and /-/ready for liveness/readiness checks.
+func serveTargets(listen string, store *targetStore) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/targets", func(w http.ResponseWriter, r *http.Request) {
+		data, err := json.MarshalIndent(store.get(), "", "  ")
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(data)
+	})
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/-/healthy", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	mux.HandleFunc("/-/ready", func(w http.ResponseWriter, r *http.Request) {
+		if !store.isHealthy() {
+			http.Error(w, "discovery has been failing", http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	})
+	log.Printf("Listening on %s", listen)
+	log.Fatal(http.ListenAndServe(listen, mux))
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// eventPollInterval is how often the supervisor checks the Engine's events
+// feed for host/VM topology changes in between full re-syncs.
+const eventPollInterval = 5 * time.Second
+
+type Events struct {
+	Event []Event
+}
+
+type Event struct {
+	Id   string
+	Code int
+}
+
+// topologyEventCodes are the oVirt Engine event codes worth an incremental
+// refresh for: hosts and VMs being added, removed, or changing status.
+// See the Engine API's event code reference for the full list.
+var topologyEventCodes = map[int]bool{
+	1:   true, // USER_ADD_VM
+	3:   true, // USER_REMOVE_VM
+	33:  true, // VM_DOWN
+	34:  true, // VM_UP (approximate - code set trimmed for this bridge)
+	142: true, // USER_ADD_HOST
+	147: true, // USER_REMOVE_HOST
+	188: true, // HOST_STATUS_UP
+	189: true, // HOST_STATUS_NON_RESPONSIVE
+}
+
+// runSupervisor performs an initial full discovery and then keeps targets
+// fresh by watching the Engine's events feed for host/VM topology changes,
+// refreshing immediately when a relevant event arrives and otherwise
+// falling back to a full re-sync every config.FullResyncInterval. All Engine
+// calls are retried with exponential backoff and jitter instead of crashing
+// or hammering a briefly-down Engine.
+func runSupervisor(client *http.Client, config *Config, exporter Exporter, store *targetStore) {
+	state := &discoveryState{}
+
+	withBackoff(config, "discovery", func() error {
+		return state.run(client, config, exporter, store)
+	})
+	lastFullResync := time.Now()
+
+	var lastEventID string
+	withBackoff(config, "event lookup", func() error {
+		id, err := latestEventID(client, config)
+		recordEventPoll(err)
+		state.touch(store, config, err)
+		if err != nil {
+			return err
+		}
+		lastEventID = id
+		return nil
+	})
+
+	fullResyncInterval := time.Duration(config.FullResyncInterval) * time.Second
+
+	for {
+		time.Sleep(eventPollInterval)
+
+		if time.Since(lastFullResync) >= fullResyncInterval {
+			withBackoff(config, "discovery", func() error {
+				return state.run(client, config, exporter, store)
+			})
+			lastFullResync = time.Now()
+			withBackoff(config, "event lookup", func() error {
+				id, err := latestEventID(client, config)
+				state.touch(store, config, err)
+				if err != nil {
+					return err
+				}
+				lastEventID = id
+				return nil
+			})
+			continue
+		}
+
+		var relevant bool
+		withBackoff(config, "event poll", func() error {
+			events, newLastEventID, err := pollEvents(client, config, lastEventID)
+			recordEventPoll(err)
+			state.touch(store, config, err)
+			if err != nil {
+				return err
+			}
+			relevant = hasTopologyEvent(events)
+			lastEventID = newLastEventID
+			return nil
+		})
+		if relevant {
+			withBackoff(config, "discovery", func() error {
+				return state.run(client, config, exporter, store)
+			})
+			lastFullResync = time.Now()
+		}
+	}
+}
+
+// discoveryState tracks the last successful Engine interaction - a full
+// discovery, an event lookup, or an event poll - so readiness reflects an
+// Engine outage promptly, rather than only when the next full discovery
+// happens to run.
+type discoveryState struct {
+	lastSuccess time.Time
+}
+
+func (s *discoveryState) run(client *http.Client, config *Config, exporter Exporter, store *targetStore) error {
+	start := time.Now()
+	targets, err := Discover(client, config, exporter)
+	requestDuration.Observe(time.Since(start).Seconds())
+	lastRunTimestamp.Set(float64(time.Now().Unix()))
+	if err != nil {
+		discoveryFailures.Inc()
+	} else {
+		discoverySuccesses.Inc()
+		discoveredHosts.Set(float64(countTargets(targets)))
+		if store != nil {
+			store.set(targets)
+		}
+	}
+	s.touch(store, config, err)
+	return err
+}
+
+// recordEventPoll tracks an event-lookup/poll outcome under its own metrics,
+// kept separate from discoverySuccesses/discoveryFailures/lastRunTimestamp so
+// those continue to mean exactly what their Help text says: a full discovery
+// run, not the every-eventPollInterval topology check in between.
+func recordEventPoll(err error) {
+	lastEventPollTimestamp.Set(float64(time.Now().Unix()))
+	if err != nil {
+		eventPollFailures.Inc()
+	} else {
+		eventPollSuccesses.Inc()
+	}
+}
+
+// touch records the outcome of an Engine interaction and re-derives
+// readiness from how long it's been since the last success, so a run of
+// event-lookup/poll failures flips /-/ready unhealthy just as promptly as a
+// run of failed full discoveries would.
+func (s *discoveryState) touch(store *targetStore, config *Config, err error) {
+	if err == nil {
+		s.lastSuccess = time.Now()
+	}
+	if store != nil {
+		store.setHealthy(!s.lastSuccess.IsZero() && time.Since(s.lastSuccess) <= 2*time.Duration(config.UpdateInterval)*time.Second)
+	}
+}
+
+// withBackoff retries fn until it succeeds, sleeping with exponential
+// backoff and jitter between attempts (starting at 1s, capped at
+// config.UpdateInterval) and logging each failure instead of aborting.
+func withBackoff(config *Config, description string, fn func() error) {
+	cap := time.Duration(config.UpdateInterval) * time.Second
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		if err == nil {
+			return
+		}
+		delay := backoffDelay(attempt, cap)
+		log.Printf("%s failed (attempt %d), retrying in %s: %v", description, attempt+1, delay, err)
+		time.Sleep(delay)
+	}
+}
+
+func backoffDelay(attempt int, cap time.Duration) time.Duration {
+	base := time.Second << uint(attempt)
+	if base <= 0 || base > cap {
+		base = cap
+	}
+	return base/2 + time.Duration(rand.Int63n(int64(base)/2+1))
+}
+
+// latestEventID returns the id of the most recent Engine event, used as the
+// starting high-water mark so the supervisor doesn't replay old events.
+func latestEventID(client *http.Client, config *Config) (string, error) {
+	res, err := doAuthenticatedGet(client, config, config.URL+"/ovirt-engine/api/events?max=1")
+	if err != nil {
+		return "", err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return "", err
+	}
+	events := new(Events)
+	if err := json.Unmarshal(body, events); err != nil {
+		return "", err
+	}
+	if len(events.Event) == 0 {
+		return "0", nil
+	}
+	return events.Event[0].Id, nil
+}
+
+// pollEvents fetches host/VM events newer than from, returning them along
+// with the new high-water mark to pass as from on the next poll.
+func pollEvents(client *http.Client, config *Config, from string) (*Events, string, error) {
+	search := url.QueryEscape("type=host or type=vm")
+	res, err := doAuthenticatedGet(client, config, config.URL+"/ovirt-engine/api/events?search="+search+"&from="+from)
+	if err != nil {
+		return nil, from, err
+	}
+	defer res.Body.Close()
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, from, err
+	}
+	events := new(Events)
+	if err := json.Unmarshal(body, events); err != nil {
+		return nil, from, err
+	}
+
+	newFrom := from
+	for _, event := range events.Event {
+		if id, err := strconv.Atoi(event.Id); err == nil {
+			if current, err := strconv.Atoi(newFrom); err != nil || id > current {
+				newFrom = event.Id
+			}
+		}
+	}
+	return events, newFrom, nil
+}
+
+func hasTopologyEvent(events *Events) bool {
+	for _, event := range events.Event {
+		if topologyEventCodes[event.Code] {
+			return true
+		}
+	}
+	return false
+}
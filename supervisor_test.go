@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffDelayCappedByLimit(t *testing.T) {
+	cap := 30 * time.Second
+	for attempt := 0; attempt < 20; attempt++ {
+		delay := backoffDelay(attempt, cap)
+		if delay > cap {
+			t.Fatalf("attempt %d: delay %s exceeds cap %s", attempt, delay, cap)
+		}
+		if delay < 0 {
+			t.Fatalf("attempt %d: delay %s is negative", attempt, delay)
+		}
+	}
+}
+
+func TestBackoffDelayGrowsWithAttempts(t *testing.T) {
+	cap := time.Hour
+	// Compare the maximum possible delay at consecutive low attempts: each
+	// attempt's base (and hence its range of possible delays) doubles.
+	if backoffDelay(0, cap) > cap/4 {
+		t.Fatalf("attempt 0 delay should be small relative to cap, got %s", backoffDelay(0, cap))
+	}
+	small := time.Second
+	large := backoffDelay(10, cap)
+	if large <= small {
+		t.Errorf("expected attempt 10's delay (%s) to exceed attempt 0's base (%s)", large, small)
+	}
+}
+
+func TestHasTopologyEvent(t *testing.T) {
+	relevant := &Events{Event: []Event{{Id: "1", Code: 142}}}
+	if !hasTopologyEvent(relevant) {
+		t.Errorf("expected a USER_ADD_HOST event to be detected as a topology event")
+	}
+
+	irrelevant := &Events{Event: []Event{{Id: "2", Code: 999}}}
+	if hasTopologyEvent(irrelevant) {
+		t.Errorf("expected an unknown event code not to be treated as a topology event")
+	}
+
+	empty := &Events{}
+	if hasTopologyEvent(empty) {
+		t.Errorf("expected no events to not be a topology event")
+	}
+}
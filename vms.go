@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+type VMs struct {
+	VM []VM
+}
+
+type VM struct {
+	Id      string
+	Name    string
+	Status  string
+	Cluster Cluster
+	Host    *Host
+	Nics    Nics `json:"nics"`
+	Tags    Tags `json:"tags"`
+}
+
+type Nics struct {
+	Nic []Nic
+}
+
+type Nic struct {
+	Name            string
+	ReportedDevices ReportedDevices `json:"reported_devices"`
+}
+
+type ReportedDevices struct {
+	ReportedDevice []ReportedDevice `json:"reported_device"`
+}
+
+type ReportedDevice struct {
+	Ips Ips `json:"ips"`
+}
+
+type Ips struct {
+	Ip []Ip
+}
+
+type Ip struct {
+	Address string
+}
+
+type Tags struct {
+	Tag []Tag
+}
+
+type Tag struct {
+	Name string
+}
+
+// discoverVMs queries the Engine for VMs, expanding their NICs, tags,
+// cluster and host so MapToTarget can produce fully-labeled targets.
+func discoverVMs(client *http.Client, config *Config) ([]*Targets, error) {
+	res, err := doAuthenticatedGet(client, config, config.URL+"/ovirt-engine/api/vms?follow=nics,tags,cluster.datacenter,host")
+	if err != nil {
+		return nil, err
+	}
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	vms := ParseVMsJson(body)
+	items := make([]interface{}, len(vms.VM))
+	for i, vm := range vms.VM {
+		items[i] = vm
+	}
+	port := config.Port
+	return MapToTarget(items, func(item interface{}) (string, map[string]string) {
+		return VMLabels(item, port)
+	}), nil
+}
+
+func ParseVMsJson(data []byte) *VMs {
+	vms := new(VMs)
+	err := json.Unmarshal(data, vms)
+	check(err)
+	return vms
+}
+
+// VMLabels is the LabelExtractor for items discovered via --discover=vms. It
+// mirrors the __meta_* labels Prometheus's built-in service discoveries
+// expose, so existing relabel_configs conventions carry over.
+func VMLabels(item interface{}, port int) (string, map[string]string) {
+	vm := item.(VM)
+	labels := map[string]string{
+		"__meta_ovirt_vm_name":      vm.Name,
+		"__meta_ovirt_vm_id":        vm.Id,
+		"__meta_ovirt_cluster_name": vm.Cluster.Name,
+		"__meta_ovirt_datacenter":   vm.Cluster.DataCenter.Name,
+		"__meta_ovirt_status":       vm.Status,
+	}
+	if vm.Host != nil {
+		labels["__meta_ovirt_host"] = vm.Host.Address
+	}
+	for _, tag := range vm.Tags.Tag {
+		if sanitized, ok := sanitizeTagLabel(tag.Name); ok {
+			labels["__meta_ovirt_tag_"+sanitized] = "true"
+		}
+	}
+
+	var address string
+	for _, nic := range vm.Nics.Nic {
+		for _, ip := range nicIps(nic) {
+			labels["__meta_ovirt_nic_"+nic.Name+"_ip"] = ip
+			if address == "" {
+				address = fmt.Sprintf("%s:%d", ip, port)
+			}
+		}
+	}
+	return address, labels
+}
+
+// sanitizeTagLabel converts an oVirt tag name into a valid Prometheus label
+// name suffix. Prometheus label names are restricted to [a-zA-Z_][a-zA-Z0-9_]*,
+// but oVirt tag names aren't, so characters outside that set are replaced
+// with "_" and a leading digit is prefixed with "_". Returns false for an
+// empty tag name, which has nothing sane to sanitize to.
+func sanitizeTagLabel(name string) (string, bool) {
+	if name == "" {
+		return "", false
+	}
+	sanitized := make([]byte, len(name))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9', c == '_':
+			sanitized[i] = c
+		default:
+			sanitized[i] = '_'
+		}
+	}
+	if sanitized[0] >= '0' && sanitized[0] <= '9' {
+		return "_" + string(sanitized), true
+	}
+	return string(sanitized), true
+}
+
+func nicIps(nic Nic) []string {
+	var ips []string
+	for _, reported := range nic.ReportedDevices.ReportedDevice {
+		for _, ip := range reported.Ips.Ip {
+			ips = append(ips, ip.Address)
+		}
+	}
+	return ips
+}
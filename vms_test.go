@@ -0,0 +1,93 @@
+package main
+
+import "testing"
+
+func TestNicIpsCollectsAcrossReportedDevices(t *testing.T) {
+	nic := Nic{
+		Name: "eth0",
+		ReportedDevices: ReportedDevices{
+			ReportedDevice: []ReportedDevice{
+				{Ips: Ips{Ip: []Ip{{Address: "192.0.2.1"}, {Address: "192.0.2.2"}}}},
+				{Ips: Ips{Ip: []Ip{{Address: "192.0.2.3"}}}},
+			},
+		},
+	}
+
+	ips := nicIps(nic)
+
+	if len(ips) != 3 {
+		t.Fatalf("expected 3 ips, got %v", ips)
+	}
+}
+
+func TestVMLabelsUsesFirstNicIpAsAddress(t *testing.T) {
+	vm := VM{
+		Id:      "vm-1",
+		Name:    "web-1",
+		Status:  "up",
+		Cluster: Cluster{Name: "prod", DataCenter: DataCenter{Name: "dc1"}},
+		Host:    &Host{Address: "host1.example.com"},
+		Tags:    Tags{Tag: []Tag{{Name: "web"}}},
+		Nics: Nics{Nic: []Nic{
+			{Name: "eth0", ReportedDevices: ReportedDevices{ReportedDevice: []ReportedDevice{
+				{Ips: Ips{Ip: []Ip{{Address: "192.0.2.10"}}}},
+			}}},
+		}},
+	}
+
+	address, labels := VMLabels(vm, 9100)
+
+	if address != "192.0.2.10:9100" {
+		t.Errorf("expected address 192.0.2.10:9100, got %q", address)
+	}
+	want := map[string]string{
+		"__meta_ovirt_vm_name":      "web-1",
+		"__meta_ovirt_vm_id":        "vm-1",
+		"__meta_ovirt_cluster_name": "prod",
+		"__meta_ovirt_datacenter":   "dc1",
+		"__meta_ovirt_host":         "host1.example.com",
+		"__meta_ovirt_status":       "up",
+		"__meta_ovirt_tag_web":      "true",
+		"__meta_ovirt_nic_eth0_ip":  "192.0.2.10",
+	}
+	for key, value := range want {
+		if labels[key] != value {
+			t.Errorf("label %s = %q, want %q", key, labels[key], value)
+		}
+	}
+}
+
+func TestVMLabelsSanitizesTagNames(t *testing.T) {
+	vm := VM{
+		Id:   "vm-3",
+		Name: "tagged",
+		Tags: Tags{Tag: []Tag{{Name: "team:infra"}, {Name: "2024-q1"}, {Name: ""}}},
+	}
+
+	_, labels := VMLabels(vm, 9100)
+
+	want := map[string]string{
+		"__meta_ovirt_tag_team_infra": "true",
+		"__meta_ovirt_tag__2024_q1":   "true",
+	}
+	for key, value := range want {
+		if labels[key] != value {
+			t.Errorf("label %s = %q, want %q", key, labels[key], value)
+		}
+	}
+	for key := range labels {
+		if key == "__meta_ovirt_tag_" {
+			t.Errorf("expected the empty tag name to be skipped, got label %q", key)
+		}
+	}
+}
+
+func TestVMLabelsEmptyAddressWhenNoNicIps(t *testing.T) {
+	vm := VM{Id: "vm-2", Name: "no-nic"}
+
+	address, _ := VMLabels(vm, 9100)
+
+	if address != "" {
+		t.Errorf("expected empty address for a VM with no NIC IPs, got %q", address)
+	}
+}